@@ -2,22 +2,33 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/cors"
+	"golang.org/x/net/http2"
 )
 
 func main() {
@@ -28,6 +39,12 @@ func main() {
 
 var (
 	debug = os.Getenv("DEBUG") != ""
+	// decodeOnStore, when set, transparently decodes the upstream body
+	// before storing it so the cache holds one identity copy regardless of
+	// what encoding upstream served. On a cache hit, clients whose
+	// Accept-Encoding lists gzip get the body re-encoded as gzip; all others
+	// get identity (br and deflate are not re-encoded).
+	decodeOnStore = os.Getenv("DECODE_ON_STORE") == "1"
 )
 
 func run() error {
@@ -36,53 +53,776 @@ func run() error {
 	cacheDir := getenv("CACHE_DIR", "")
 
 	ctx := context.Background()
-	cache := NewLocalCache(cacheDir)
+	cache := NewLocalCache(cacheDir, getenvInt64("CACHE_MEM_BYTES", 0))
 	cache.Run(ctx)
 
+	policy := NewCachePolicy(getenv("CACHE_INCLUDE", ""), getenv("CACHE_EXCLUDE", ""), getenv("CACHE_TTL", ""))
+
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Proxying to %s", target)
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{}
 	c := cors.Default()
 
-	h := c.Handler(&ProxyHandler{targetURL: target, cache: cache})
-	return http.ListenAndServe(":"+port, h)
+	h := c.Handler(&ProxyHandler{
+		targetURL:        target,
+		cache:            cache,
+		policy:           policy,
+		client:           &http.Client{Transport: transport},
+		coalesceBufBytes: getenvInt64("CACHE_COALESCE_BUFFER_BYTES", 4<<20),
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", cache.metricsHandler)
+	mux.Handle("/", h)
+	return http.ListenAndServe(":"+port, mux)
+}
+
+// newUpstreamTransport builds the *http.Transport used for every upstream
+// request. Unlike mutating http.DefaultTransport, this is scoped to this
+// proxy's own *http.Client so tests can inject a fake transport and
+// operators can run this proxy behind another one: Proxy honors
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY via http.ProxyFromEnvironment, tunneling
+// HTTPS upstream targets through CONNECT whenever a proxy applies.
+func newUpstreamTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: os.Getenv("INSECURE_SKIP_VERIFY") == "1",
+	}
+	if caFile := getenv("UPSTREAM_CA_FILE", ""); caFile != "" {
+		pool, err := loadCAPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading UPSTREAM_CA_FILE: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout: getenvDuration("DIAL_TIMEOUT", 30*time.Second),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   getenvDuration("TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		ResponseHeaderTimeout: getenvDuration("RESPONSE_HEADER_TIMEOUT", 0),
+		MaxIdleConns:          getenvInt("MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   getenvInt("MAX_IDLE_CONNS_PER_HOST", 10),
+	}
+	// A custom TLSClientConfig disables Go's automatic HTTP/2 upgrade;
+	// opt back in explicitly.
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, fmt.Errorf("configuring HTTP/2: %w", err)
+	}
+	return transport, nil
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func getenvDuration(name string, _default time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return _default
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s %q: %+v", name, v, err)
+		return _default
+	}
+	return d
+}
+
+func getenvInt(name string, _default int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return _default
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s %q: %+v", name, v, err)
+		return _default
+	}
+	return n
+}
+
+func getenvInt64(name string, _default int64) int64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return _default
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q: %+v", name, v, err)
+		return _default
+	}
+	return n
+}
+
+// CachePolicy decides whether a request path is eligible for caching at
+// all, and whether it carries a TTL that should win over whatever the
+// upstream's Cache-Control/Expires headers say.
+//
+// CACHE_INCLUDE and CACHE_EXCLUDE are comma-separated lists of glob
+// patterns (or "re:<regexp>" for regex patterns) matched against the
+// request path; exclude always wins over include. CACHE_TTL is a
+// comma-separated list of pattern=duration pairs, e.g.
+// "*.deb=720h,Release=0s", consulted for both the path and its base name.
+type CachePolicy struct {
+	include []string
+	exclude []string
+	ttls    []ttlRule
+}
+
+type ttlRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+func NewCachePolicy(include, exclude, ttl string) *CachePolicy {
+	return &CachePolicy{
+		include: parsePatternList(include),
+		exclude: parsePatternList(exclude),
+		ttls:    parseTTLRules(ttl),
+	}
+}
+
+// Allowed reports whether path may be read from or written to the cache.
+func (p *CachePolicy) Allowed(path string) bool {
+	if matchAnyPattern(p.exclude, path) {
+		return false
+	}
+	if len(p.include) > 0 && !matchAnyPattern(p.include, path) {
+		return false
+	}
+	return true
+}
+
+// TTL returns the operator-configured TTL override for path, if any.
+func (p *CachePolicy) TTL(path string) (time.Duration, bool) {
+	for _, rule := range p.ttls {
+		if matchPattern(rule.pattern, path) {
+			return rule.ttl, true
+		}
+	}
+	return 0, false
+}
+
+func parsePatternList(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func parseTTLRules(s string) []ttlRule {
+	var rules []ttlRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok {
+			log.Printf("Invalid CACHE_TTL entry %q: missing '='", part)
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			log.Printf("Invalid CACHE_TTL entry %q: %+v", part, err)
+			continue
+		}
+		rules = append(rules, ttlRule{pattern: strings.TrimSpace(pattern), ttl: d})
+	}
+	return rules
+}
+
+func matchAnyPattern(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches pattern, a glob or "re:"-prefixed regexp, against
+// both the full path and its base name so rules like "Release" or
+// "*.deb" work regardless of the directory they show up in.
+func matchPattern(pattern, path string) bool {
+	if re, ok := strings.CutPrefix(pattern, "re:"); ok {
+		matched, err := regexp.MatchString(re, path)
+		return err == nil && matched
+	}
+	if ok, err := filepath.Match(pattern, path); err == nil && ok {
+		return true
+	}
+	ok, err := filepath.Match(pattern, filepath.Base(path))
+	return err == nil && ok
+}
+
+// CacheEntry is the sidecar metadata stored alongside each cached response
+// body, recorded at CACHE_DIR/<shard>/<key>.meta.json.
+type CacheEntry struct {
+	StatusCode      int            `json:"status_code"`
+	Header          http.Header    `json:"header"`
+	ContentEncoding string         `json:"content_encoding"`
+	StoredAt        time.Time      `json:"stored_at"`
+	UpstreamURL     string         `json:"upstream_url"`
+	TTLOverride     *time.Duration `json:"ttl_override,omitempty"`
+}
+
+// freshnessLifetime returns how long entry is fresh for after StoredAt. A
+// CachePolicy TTL override recorded at store time always wins over the
+// upstream's own Cache-Control/Expires headers; absent that, s-maxage and
+// max-age win over Expires per RFC 7234.
+func (e *CacheEntry) freshnessLifetime() (time.Duration, bool) {
+	if e.TTLOverride != nil {
+		return *e.TTLOverride, true
+	}
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if cc.sMaxAge != nil {
+		return *cc.sMaxAge, true
+	}
+	if cc.maxAge != nil {
+		return *cc.maxAge, true
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		expTime, err := http.ParseTime(exp)
+		if err != nil {
+			return 0, false
+		}
+		base := e.StoredAt
+		if date := e.Header.Get("Date"); date != "" {
+			if d, err := http.ParseTime(date); err == nil {
+				base = d
+			}
+		}
+		return expTime.Sub(base), true
+	}
+	return 0, false
+}
+
+// currentAge is how long ago entry was stored.
+func (e *CacheEntry) currentAge() time.Duration {
+	return time.Since(e.StoredAt)
+}
+
+// isFresh reports whether entry can be served without revalidation.
+func (e *CacheEntry) isFresh() bool {
+	if e.TTLOverride == nil {
+		cc := parseCacheControl(e.Header.Get("Cache-Control"))
+		if cc.noCache {
+			return false
+		}
+	}
+	lifetime, ok := e.freshnessLifetime()
+	if !ok {
+		return false
+	}
+	return e.currentAge() < lifetime
+}
+
+// staleButUsable reports whether entry is stale but still within its
+// stale-while-revalidate window, per RFC 5861. must-revalidate forbids
+// serving a stale entry at all, so it takes priority over any
+// stale-while-revalidate window once the entry has gone stale.
+func (e *CacheEntry) staleButUsable() bool {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if cc.mustRevalidate || cc.staleWhileRevalidate == nil {
+		return false
+	}
+	lifetime, ok := e.freshnessLifetime()
+	if !ok {
+		return false
+	}
+	return e.currentAge() < lifetime+*cc.staleWhileRevalidate
+}
+
+// cacheControl holds the directives this proxy understands from a
+// Cache-Control header.
+type cacheControl struct {
+	noStore              bool
+	noCache              bool
+	private              bool
+	mustRevalidate       bool
+	maxAge               *time.Duration
+	sMaxAge              *time.Duration
+	staleWhileRevalidate *time.Duration
+}
+
+func parseCacheControl(header string) cacheControl {
+	var cc cacheControl
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch name {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "must-revalidate":
+			cc.mustRevalidate = true
+		case "max-age":
+			if d, err := parseDeltaSeconds(value); err == nil {
+				cc.maxAge = &d
+			}
+		case "s-maxage":
+			if d, err := parseDeltaSeconds(value); err == nil {
+				cc.sMaxAge = &d
+			}
+		case "stale-while-revalidate":
+			if d, err := parseDeltaSeconds(value); err == nil {
+				cc.staleWhileRevalidate = &d
+			}
+		}
+	}
+	return cc
 }
 
+func parseDeltaSeconds(s string) (time.Duration, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// isCacheableStatus reports whether a status code is cacheable by default
+// per RFC 7231 §6.1, absent any explicit Cache-Control directive.
+//
+// StatusPartialContent is deliberately excluded: the cache key doesn't
+// fold in the request's Range header, so a stored 206 could later be
+// served whole to a plain GET (or vice versa) of the same URL.
+func isCacheableStatus(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// isCacheableResponse reports whether resp may be stored at all.
+func isCacheableResponse(resp *http.Response) bool {
+	if !isCacheableStatus(resp.StatusCode) {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	return !cc.noStore
+}
+
+// LocalCache is a content-addressed on-disk cache. Each entry is stored as
+// two files under CACHE_DIR: <shard>/<key> holds the raw response body and
+// <shard>/<key>.meta.json holds its CacheEntry. Keys are sharded two levels
+// deep (ab/cd/abcdef...) so no single directory accumulates too many files.
+// An optional in-memory LRU (see memBudgetBytes) sits in front of it so hot
+// entries don't round-trip through disk on every request.
 type LocalCache struct {
-	data     map[string][]byte
-	filePath string
+	dir   string
+	mem   *memLRU
+	stats cacheStats
 }
 
-func NewLocalCache(cacheDir string) *LocalCache {
-	var fp string
-	if cacheDir != "" {
-		fp = path.Join(cacheDir, "cache.json")
+// NewLocalCache returns a cache rooted at cacheDir. If memBudgetBytes > 0,
+// an in-memory LRU up to that many bytes of bodies is kept in front of
+// disk (CACHE_MEM_BYTES); hot entries get promoted into it on read and
+// write, and cold ones are evicted once the budget is exceeded.
+func NewLocalCache(cacheDir string, memBudgetBytes int64) *LocalCache {
+	c := &LocalCache{dir: cacheDir}
+	if memBudgetBytes > 0 {
+		c.mem = newMemLRU(memBudgetBytes, &c.stats.evictions)
 	}
-	return &LocalCache{filePath: fp, data: map[string][]byte{}}
+	return c
 }
 
 func (c *LocalCache) useCache() bool {
-	return c.filePath != ""
+	return c.dir != ""
+}
+
+// cacheStats are the hit/miss/eviction counters served at /metrics.
+type cacheStats struct {
+	memHits   int64
+	diskHits  int64
+	misses    int64
+	evictions int64
+}
+
+func (c *LocalCache) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "simple_proxy_cache_mem_hits_total", "Cache hits served from the in-memory LRU.", atomic.LoadInt64(&c.stats.memHits))
+	writeMetric(w, "simple_proxy_cache_disk_hits_total", "Cache hits served from disk.", atomic.LoadInt64(&c.stats.diskHits))
+	writeMetric(w, "simple_proxy_cache_misses_total", "Cache misses.", atomic.LoadInt64(&c.stats.misses))
+	writeMetric(w, "simple_proxy_cache_mem_evictions_total", "In-memory LRU evictions.", atomic.LoadInt64(&c.stats.evictions))
+}
+
+func writeMetric(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// memEntry is one in-memory LRU slot: a cached body buffered fully in RAM
+// alongside its metadata.
+type memEntry struct {
+	key   string
+	entry CacheEntry
+	body  []byte
+}
+
+// memLRU is a bounded-byte-budget, in-memory cache of hot entries sitting
+// in front of LocalCache's on-disk store.
+type memLRU struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	curBytes  int64
+	order     *list.List
+	items     map[string]*list.Element
+	evictions *int64
+}
+
+func newMemLRU(maxBytes int64, evictions *int64) *memLRU {
+	return &memLRU{maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}, evictions: evictions}
+}
+
+func (m *memLRU) get(key string) (*memEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memEntry), true
+}
+
+func (m *memLRU) put(key string, entry CacheEntry, body []byte) {
+	size := int64(len(body))
+	if size > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[key]; ok {
+		m.curBytes -= int64(len(el.Value.(*memEntry).body))
+		el.Value = &memEntry{key: key, entry: entry, body: body}
+		m.order.MoveToFront(el)
+	} else {
+		m.items[key] = m.order.PushFront(&memEntry{key: key, entry: entry, body: body})
+	}
+	m.curBytes += size
+
+	for m.curBytes > m.maxBytes {
+		back := m.order.Back()
+		if back == nil {
+			break
+		}
+		evicted := back.Value.(*memEntry)
+		m.order.Remove(back)
+		delete(m.items, evicted.key)
+		m.curBytes -= int64(len(evicted.body))
+		atomic.AddInt64(m.evictions, 1)
+	}
 }
 
-// Save saves the cache to the file
-func (c *LocalCache) Save() error {
-	buf, err := json.Marshal(c.data)
+// updateEntry refreshes just the metadata for an already-promoted key,
+// e.g. to reflect a 304 revalidation's new StoredAt.
+func (m *memLRU) updateEntry(key string, entry CacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		el.Value.(*memEntry).entry = entry
+	}
+}
+
+// cacheKey computes the content-addressed key for a request: a SHA-256 of
+// the method, URL, and the value of any header named in varyHeaders.
+func cacheKey(method, rawURL string, varyHeaders []string, header http.Header) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", method, rawURL)
+	for _, vh := range varyHeaders {
+		fmt.Fprintf(h, "%s: %s\n", vh, header.Get(vh))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// varyKey derives the cache key actually used to store/load an entry once
+// the upstream's Vary header is known: baseKey combined with the request's
+// value for each header the upstream varies on.
+func varyKey(baseKey string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return baseKey
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", baseKey)
+	for _, vh := range vary {
+		fmt.Fprintf(h, "%s: %s\n", vh, header.Get(vh))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// shardDir returns the two-level sharded directory a key's files live under.
+func (c *LocalCache) shardDir(key string) string {
+	return filepath.Join(c.dir, key[:2], key[2:4])
+}
+
+func (c *LocalCache) entryPaths(key string) (dataPath, metaPath string) {
+	dir := c.shardDir(key)
+	return filepath.Join(dir, key), filepath.Join(dir, key+".meta.json")
+}
+
+func (c *LocalCache) varyIndexPath(baseKey string) string {
+	return filepath.Join(c.shardDir(baseKey), baseKey+".vary.json")
+}
+
+// readVary returns the Vary header names the last response for baseKey was
+// stored under, or nil if none is recorded.
+func (c *LocalCache) readVary(baseKey string) []string {
+	buf, err := os.ReadFile(c.varyIndexPath(baseKey))
+	if err != nil {
+		return nil
+	}
+	var vary []string
+	if err := json.Unmarshal(buf, &vary); err != nil {
+		return nil
+	}
+	return vary
+}
+
+func (c *LocalCache) writeVary(baseKey string, vary []string) error {
+	dir := c.shardDir(baseKey)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(vary)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(c.filePath, buf, 0644)
+	return writeFileAtomic(dir, c.varyIndexPath(baseKey), bytes.NewReader(buf))
 }
 
-// Load loads the cache from the file
-func (c *LocalCache) Load() error {
-	buf, err := os.ReadFile(c.filePath)
+// resolveKey turns a base (method+URL) key into the key an entry is
+// actually stored under, given the Vary header names recorded for it.
+func (c *LocalCache) resolveKey(baseKey string, reqHeader http.Header) string {
+	return varyKey(baseKey, c.readVary(baseKey), reqHeader)
+}
+
+// touch rewrites an existing entry's metadata, e.g. to bump StoredAt after
+// a 304 revalidation confirms the cached body is still valid. The body
+// file is left untouched.
+func (c *LocalCache) touch(key string, entry CacheEntry) error {
+	dir := c.shardDir(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	_, metaPath := c.entryPaths(key)
+	metaBuf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dir, metaPath, bytes.NewReader(metaBuf)); err != nil {
+		return err
+	}
+	if c.mem != nil {
+		c.mem.updateEntry(key, entry)
+	}
+	return nil
+}
+
+// Get opens the cached body for key along with its metadata. The caller
+// must close the returned ReadCloser. It returns an error satisfying
+// os.IsNotExist when there is no entry for key. A configured in-memory LRU
+// is checked first; disk is only touched on a miss there.
+func (c *LocalCache) Get(key string) (io.ReadCloser, *CacheEntry, error) {
+	if c.mem != nil {
+		if me, ok := c.mem.get(key); ok {
+			atomic.AddInt64(&c.stats.memHits, 1)
+			entry := me.entry
+			return io.NopCloser(bytes.NewReader(me.body)), &entry, nil
+		}
+	}
+
+	dataPath, metaPath := c.entryPaths(key)
+
+	metaBuf, err := os.ReadFile(metaPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			atomic.AddInt64(&c.stats.misses, 1)
+		}
+		return nil, nil, err
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(metaBuf, &entry); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			atomic.AddInt64(&c.stats.misses, 1)
 		}
+		return nil, nil, err
+	}
+	atomic.AddInt64(&c.stats.diskHits, 1)
+
+	if c.mem != nil {
+		if fi, err := f.Stat(); err == nil && fi.Size() <= c.mem.maxBytes {
+			if body, err := os.ReadFile(dataPath); err == nil {
+				c.mem.put(key, entry, body)
+			}
+		}
+	}
+
+	return f, &entry, nil
+}
+
+// Put stores body and entry for key, writing both files via a temp-file
+// then rename so a crash mid-write never leaves a corrupt entry behind.
+func (c *LocalCache) Put(key string, entry CacheEntry, body io.Reader) error {
+	return c.PutStreaming(key, entry, func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+}
+
+// PutStreaming is like Put, but lets the caller write the body directly
+// into the destination file via writeBody instead of handing over an
+// already-complete Reader. This is what lets a response be tee'd to a
+// client and the cache at once via a single io.MultiWriter.
+func (c *LocalCache) PutStreaming(key string, entry CacheEntry, writeBody func(io.Writer) error) error {
+	dir := c.shardDir(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dataPath, metaPath := c.entryPaths(key)
+
+	var memW *boundedWriter
+	body := writeBody
+	if c.mem != nil {
+		memW = &boundedWriter{buf: &bytes.Buffer{}, max: c.mem.maxBytes}
+		body = func(w io.Writer) error {
+			return writeBody(io.MultiWriter(w, memW))
+		}
+	}
+
+	if err := writeAtomic(dir, dataPath, body); err != nil {
+		return err
+	}
+
+	metaBuf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dir, metaPath, bytes.NewReader(metaBuf)); err != nil {
+		return err
+	}
+
+	if c.mem != nil && !memW.overflowed {
+		c.mem.put(key, entry, memW.buf.Bytes())
+	}
+	return nil
+}
+
+// boundedWriter discards writes once max bytes have been buffered, so
+// promoting a response into the in-memory LRU never grows unbounded for
+// bodies larger than the configured budget. overflowed tracks whether the
+// total written ever exceeded max, since buf.Len() alone can't tell a
+// body that exactly fit from one that got silently truncated.
+type boundedWriter struct {
+	buf        *bytes.Buffer
+	max        int64
+	overflowed bool
+}
+
+func (b *boundedWriter) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()) < b.max {
+		remaining := b.max - int64(b.buf.Len())
+		if int64(len(p)) > remaining {
+			b.buf.Write(p[:remaining])
+			b.overflowed = true
+		} else {
+			b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.overflowed = true
+	}
+	return len(p), nil
+}
+
+func writeFileAtomic(dir, finalPath string, r io.Reader) error {
+	return writeAtomic(dir, finalPath, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeAtomic runs write against a temp file under dir and renames it to
+// finalPath only once write succeeds, so a crash mid-write never leaves a
+// corrupt entry behind.
+func writeAtomic(dir, finalPath string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(dir, filepath.Base(finalPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), finalPath)
+}
+
+// Load walks the existing shards and logs how many entries are present. It
+// never reads an entry's body into memory; entries are discovered lazily by
+// key when Get is called.
+func (c *LocalCache) Load() error {
+	n := 0
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, ".meta.json") {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	return json.Unmarshal(buf, &c.data)
+	log.Printf("Cache loaded: %d entries", n)
+	return nil
 }
 
 func (c *LocalCache) Run(ctx context.Context) {
@@ -90,33 +830,26 @@ func (c *LocalCache) Run(ctx context.Context) {
 		return
 	}
 
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Printf("Error creating cache dir: %+v", err)
+		return
+	}
 	if err := c.Load(); err != nil {
 		log.Printf("Error loading cache: %+v", err)
 	}
-
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				if err := c.Save(); err != nil {
-					log.Printf("Error saving cache: %+v", err)
-				}
-				if debug {
-					log.Printf("Cache saved.")
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
 }
 
 type ProxyHandler struct {
 	targetURL string
 	cache     *LocalCache
+	policy    *CachePolicy
+	client    *http.Client
+
+	// coalesceBufBytes bounds the per-request broadcast buffer used to fan
+	// a single upstream fetch out to concurrent identical requests (see
+	// serveCoalesced). CACHE_COALESCE_BUFFER_BYTES.
+	coalesceBufBytes int64
+	inflight         sync.Map // cache key -> *broadcastBuffer
 }
 
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -125,38 +858,58 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("---")
 	log.Printf("path: %s", p)
 
-	if r.Method == http.MethodGet && h.cache.useCache() {
-		if cached, ok := h.cache.data[p]; ok {
-			log.Printf("==> Cache hit")
-			if _, err := io.Copy(w, bytes.NewReader(cached)); err != nil {
-				e := fmt.Errorf("Error writing response: %+v\n", err)
-				http.Error(w, e.Error(), http.StatusInternalServerError)
+	target, err := url.Parse(h.targetURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	baseKey := cacheKey(r.Method, p, nil, r.Header)
+	var revalidating *CacheEntry
+	cacheEligible := r.Method == http.MethodGet && h.cache.useCache() && h.policy.Allowed(r.URL.Path)
+
+	if cacheEligible {
+		ckey := h.cache.resolveKey(baseKey, r.Header)
+		if body, entry, err := h.cache.Get(ckey); err == nil {
+			switch {
+			case entry.isFresh():
+				log.Printf("==> Cache hit (fresh): %s", p)
+				serveCacheEntry(w, r, entry, body)
+				return
+			case entry.staleButUsable():
+				log.Printf("==> Cache hit (stale-while-revalidate): %s", p)
+				serveCacheEntry(w, r, entry, body)
+				go h.revalidate(r.Clone(context.Background()), target, baseKey, entry)
+				return
+			default:
+				log.Printf("==> Cache stale, revalidating: %s", p)
+				revalidating = entry
+				body.Close()
 			}
-			return
+		} else if !os.IsNotExist(err) {
+			log.Printf("Error reading cache entry: %+v", err)
 		} else {
-			var keys []string
-			for k := range h.cache.data {
-				keys = append(keys, k)
-			}
-			log.Printf("Cache missed: current keys: %+v", keys)
+			log.Printf("Cache missed: %s", p)
 		}
 	}
 
-	target, err := url.Parse(h.targetURL)
-	if err != nil {
-		log.Fatal(err)
+	if cacheEligible && revalidating == nil {
+		h.serveCoalesced(w, r, baseKey, target)
+		return
 	}
+
 	rewriteRequestURL(r, target)
 	r.Host = ""
 	r.RequestURI = ""
-	// remove If-None-Match and If-Modified-Since to force-fetch when cache missed in proxy
 	r.Header.Del("If-None-Match")
 	r.Header.Del("If-Modified-Since")
+	if revalidating != nil {
+		setConditionalHeaders(r.Header, revalidating)
+	}
 	if debug {
 		log.Printf("==> req[%s]: %+v", p, r)
 	}
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := h.client.Do(r)
 	if err != nil {
 		log.Printf("Error forwarding request: %+v", err)
 		http.Error(w, err.Error(), resp.StatusCode)
@@ -167,6 +920,23 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	if revalidating != nil && resp.StatusCode == http.StatusNotModified {
+		log.Printf("==> Revalidated (304): %s", p)
+		ckey := h.cache.resolveKey(baseKey, r.Header)
+		revalidating.StoredAt = time.Now()
+		if err := h.cache.touch(ckey, *revalidating); err != nil {
+			log.Printf("Error updating cache entry: %+v", err)
+		}
+		body, entry, err := h.cache.Get(ckey)
+		if err != nil {
+			log.Printf("Error reading revalidated cache entry: %+v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveCacheEntry(w, r, entry, body)
+		return
+	}
+
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -174,7 +944,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	if r.Method != http.MethodGet || !h.cache.useCache() {
+	if !cacheEligible || !isCacheableResponse(resp) {
 		if _, err := io.Copy(w, resp.Body); err != nil {
 			e := fmt.Errorf("Error reading response: %+v\n", err)
 			http.Error(w, e.Error(), http.StatusInternalServerError)
@@ -182,27 +952,383 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Make gzip optional
 	log.Printf("==> Caching response: %s", p)
-	gr, err := gzip.NewReader(io.TeeReader(resp.Body, w))
-	if errors.Is(err, io.EOF) {
-		log.Printf("<== EOF: %s", p)
+	h.cacheResponse(baseKey, resp, w)
+}
+
+// serveCacheEntry writes a cached entry's headers, status and body to w,
+// closing body once done. If entry was stored decoded (DECODE_ON_STORE)
+// and r's Accept-Encoding asks for gzip, the body is gzip-encoded on the
+// fly instead of always being served as identity.
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *CacheEntry, body io.ReadCloser) {
+	defer body.Close()
+
+	if decodeOnStore && entry.ContentEncoding == "" && acceptsGzip(r) {
+		serveGzipEncoded(w, entry, body)
 		return
-	} else if err != nil {
-		log.Printf("Error: create gzip reader: %+v", err)
+	}
+
+	for key, values := range entry.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(entry.StatusCode)
+	if _, err := io.Copy(w, body); err != nil {
+		e := fmt.Errorf("Error writing response: %+v\n", err)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGzipEncoded re-encodes a decoded cache entry's body as gzip before
+// writing it, since its stored (identity) Content-Length no longer applies.
+func serveGzipEncoded(w http.ResponseWriter, entry *CacheEntry, body io.ReadCloser) {
+	for key, values := range entry.Header {
+		if strings.EqualFold(key, "Content-Length") {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(entry.StatusCode)
+
+	gw := gzip.NewWriter(w)
+	defer gw.Close()
+	if _, err := io.Copy(gw, body); err != nil {
+		log.Printf("Error: gzip-encode cached response: %+v", err)
+	}
+}
+
+// setConditionalHeaders adds If-None-Match/If-Modified-Since to header so
+// a stale entry can be revalidated instead of re-fetched from scratch.
+func setConditionalHeaders(header http.Header, entry *CacheEntry) {
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// revalidate performs a conditional GET for a stale-while-revalidate entry
+// in the background, refreshing the cache without blocking the client that
+// was already served the stale copy.
+func (h *ProxyHandler) revalidate(r *http.Request, target *url.URL, baseKey string, entry *CacheEntry) {
+	rewriteRequestURL(r, target)
+	r.Host = ""
+	r.RequestURI = ""
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	setConditionalHeaders(r.Header, entry)
+
+	resp, err := h.client.Do(r)
+	if err != nil {
+		log.Printf("Error revalidating %s: %+v", r.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	ckey := h.cache.resolveKey(baseKey, r.Header)
+	if resp.StatusCode == http.StatusNotModified {
+		entry.StoredAt = time.Now()
+		if err := h.cache.touch(ckey, *entry); err != nil {
+			log.Printf("Error updating cache entry: %+v", err)
+		}
+		return
+	}
+	if !isCacheableResponse(resp) {
+		return
+	}
+	h.cacheResponse(baseKey, resp, io.Discard)
+}
+
+// cacheResponse records resp's Vary header (if any) and stores its body.
+// By default the raw bytes are stored exactly as delivered upstream,
+// Content-Encoding included, and those same bytes are what's streamed to
+// out via a single io.MultiWriter — no decode-then-reencode round trip.
+// In DECODE_ON_STORE mode the stored copy is transparently decoded
+// (gzip/deflate) so the cache can dedupe across encodings; out still
+// receives the original encoded bytes untouched.
+func (h *ProxyHandler) cacheResponse(baseKey string, resp *http.Response, out io.Writer) {
+	if vary := resp.Header.Values("Vary"); len(vary) > 0 {
+		if err := h.cache.writeVary(baseKey, splitVaryHeaders(vary)); err != nil {
+			log.Printf("Error writing vary index: %+v", err)
+		}
+	}
+	ckey := h.cache.resolveKey(baseKey, resp.Request.Header)
+
+	entry := CacheEntry{
+		StatusCode:      resp.StatusCode,
+		Header:          resp.Header.Clone(),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		StoredAt:        time.Now(),
+		UpstreamURL:     h.targetURL,
+	}
+	if ttl, ok := h.policy.TTL(resp.Request.URL.Path); ok {
+		entry.TTLOverride = &ttl
+	}
+
+	if !decodeOnStore {
+		err := h.cache.PutStreaming(ckey, entry, func(w io.Writer) error {
+			_, err := io.Copy(io.MultiWriter(out, w), resp.Body)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error: write cache entry: %+v", err)
+			return
+		}
+		log.Printf("<== Cache created")
+		return
+	}
+
+	teed := io.TeeReader(resp.Body, out)
+	decoder, err := newContentDecoder(entry.ContentEncoding, teed)
+	if err != nil {
+		log.Printf("Cannot decode-on-store (%+v), storing raw", err)
+		if err := h.cache.Put(ckey, entry, teed); err != nil {
+			log.Printf("Error: write cache entry: %+v", err)
+		}
+		log.Printf("<== Cache created")
+		return
+	}
+	defer decoder.Close()
+
+	entry.ContentEncoding = ""
+	entry.Header.Del("Content-Encoding")
+	entry.Header.Del("Content-Length")
+	if err := h.cache.Put(ckey, entry, decoder); err != nil {
+		log.Printf("Error: write cache entry: %+v", err)
+		return
+	}
+	log.Printf("<== Cache created (decoded)")
+}
+
+// newContentDecoder wraps r with a decoder for the given Content-Encoding.
+// Brotli ("br") isn't decoded since the standard library has no decoder
+// for it and this proxy doesn't carry a third-party dependency for it.
+func newContentDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return io.NopCloser(flate.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content-encoding: %s", encoding)
+	}
+}
+
+// splitVaryHeaders normalizes the (possibly multiple, comma-separated)
+// values of a Vary header into a flat list of canonical header names.
+func splitVaryHeaders(vary []string) []string {
+	var names []string
+	for _, v := range vary {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// serveCoalesced serves a cache-eligible GET that missed (or needs no
+// revalidation), sharing a single upstream fetch across any number of
+// concurrent identical requests instead of letting each one hit upstream
+// and race to write the same cache entry. The first caller for a given
+// cache key becomes the leader and performs the fetch; everyone else
+// attaches to the leader's broadcastBuffer and streams the response as
+// it arrives rather than waiting for the leader to finish.
+func (h *ProxyHandler) serveCoalesced(w http.ResponseWriter, r *http.Request, baseKey string, target *url.URL) {
+	ckey := h.cache.resolveKey(baseKey, r.Header)
+
+	bb := newBroadcastBuffer(h.coalesceBufBytes)
+	actual, loaded := h.inflight.LoadOrStore(ckey, bb)
+	if loaded {
+		bb = actual.(*broadcastBuffer)
+		log.Printf("==> Coalescing onto in-flight request: %s", r.URL.String())
+	} else {
+		go func() {
+			defer h.inflight.Delete(ckey)
+			h.fetchAndBroadcast(r, target, baseKey, bb)
+		}()
+	}
+
+	status, header, err := bb.waitHeader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	defer gr.Close()
+	for key, values := range header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(status)
+	if err := streamBroadcast(w, bb); err != nil {
+		log.Printf("Error streaming coalesced response: %+v", err)
+	}
+}
+
+// fetchAndBroadcast performs the single upstream fetch on behalf of every
+// request coalesced onto bb, caching the response the same way the
+// non-coalesced path does (cacheResponse still does the actual cache
+// write; bb just stands in for the original client's http.ResponseWriter
+// so followers see the same bytes as they're produced).
+func (h *ProxyHandler) fetchAndBroadcast(r *http.Request, target *url.URL, baseKey string, bb *broadcastBuffer) {
+	req := r.Clone(context.Background())
+	rewriteRequestURL(req, target)
+	req.Host = ""
+	req.RequestURI = ""
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Printf("Error forwarding coalesced request: %+v", err)
+		bb.Close(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	bb.SetHeader(resp.StatusCode, resp.Header)
 
-	buf := &bytes.Buffer{}
-	if _, err := io.Copy(buf, gr); err != nil {
-		log.Printf("Error: read response by gzip reader: %+v", err)
+	if !isCacheableResponse(resp) {
+		if _, err := io.Copy(bb, resp.Body); err != nil {
+			log.Printf("Error streaming coalesced response: %+v", err)
+		}
+		bb.Close(nil)
 		return
 	}
 
-	h.cache.data[p] = buf.Bytes()
-	log.Printf("<== Cache created: %s", p)
+	log.Printf("==> Caching response: %s", req.URL.String())
+	h.cacheResponse(baseKey, resp, bb)
+	bb.Close(nil)
+}
+
+// errBroadcastOverflow is surfaced to followers once a coalesced
+// response's body has grown past the buffer's byte budget; the leader
+// keeps writing the full body to disk regardless, only the in-memory
+// fan-out to followers is truncated.
+var errBroadcastOverflow = errors.New("coalesced response exceeded broadcast buffer budget")
+
+// broadcastBuffer lets one upstream response be streamed to an arbitrary
+// number of followers as it arrives. It is not a literal ring buffer —
+// bytes are appended to a growing buffer (capped at maxBytes) and each
+// follower tracks its own read offset into it, which is simpler than a
+// true ring buffer and fine given responses are bounded by maxBytes.
+type broadcastBuffer struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       bytes.Buffer
+	maxBytes  int64
+	headerSet bool
+	status    int
+	header    http.Header
+	closed    bool
+	err       error
+}
+
+func newBroadcastBuffer(maxBytes int64) *broadcastBuffer {
+	bb := &broadcastBuffer{maxBytes: maxBytes}
+	bb.cond = sync.NewCond(&bb.mu)
+	return bb
+}
+
+// SetHeader records the upstream response's status and header, unblocking
+// any followers waiting in waitHeader.
+func (bb *broadcastBuffer) SetHeader(status int, header http.Header) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	bb.status = status
+	bb.header = header
+	bb.headerSet = true
+	bb.cond.Broadcast()
+}
+
+// Write appends p for any followers currently reading. Once maxBytes has
+// been buffered, further bytes are dropped from the broadcast (though the
+// leader's own write to disk, via cacheResponse's separate io.MultiWriter,
+// is unaffected) and followers are failed with errBroadcastOverflow.
+func (bb *broadcastBuffer) Write(p []byte) (int, error) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if int64(bb.buf.Len()) >= bb.maxBytes {
+		bb.err = errBroadcastOverflow
+	} else if remaining := bb.maxBytes - int64(bb.buf.Len()); int64(len(p)) > remaining {
+		bb.buf.Write(p[:remaining])
+		bb.err = errBroadcastOverflow
+	} else {
+		bb.buf.Write(p)
+	}
+	bb.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close marks bb done; if err is non-nil and no error has been recorded
+// yet, it becomes the error returned to any follower still reading.
+func (bb *broadcastBuffer) Close(err error) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	bb.closed = true
+	if err != nil && bb.err == nil {
+		bb.err = err
+	}
+	bb.cond.Broadcast()
+}
 
+// waitHeader blocks until the leader has recorded the upstream response's
+// status and header, or bb was closed with an error before that happened.
+func (bb *broadcastBuffer) waitHeader() (int, http.Header, error) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	for !bb.headerSet && !bb.closed {
+		bb.cond.Wait()
+	}
+	if !bb.headerSet {
+		return 0, nil, bb.err
+	}
+	return bb.status, bb.header, nil
+}
+
+// streamBroadcast copies bb's body to w as it arrives, blocking for more
+// bytes until bb is closed or fails.
+func streamBroadcast(w io.Writer, bb *broadcastBuffer) error {
+	offset := 0
+	for {
+		bb.mu.Lock()
+		for bb.buf.Len() <= offset && !bb.closed && bb.err == nil {
+			bb.cond.Wait()
+		}
+		chunk := append([]byte(nil), bb.buf.Bytes()[offset:]...)
+		closed, err := bb.closed, bb.err
+		bb.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, werr := w.Write(chunk); werr != nil {
+				return werr
+			}
+			offset += len(chunk)
+		}
+		if err != nil {
+			return err
+		}
+		if closed {
+			return nil
+		}
+	}
 }
 
 func mustgetenv(name string) string {
@@ -250,7 +1376,7 @@ func joinURLPath(a, b *url.URL) (path, rawpath string) {
 	case aslash && bslash:
 		return a.Path + b.Path[1:], apath + bpath[1:]
 	case !aslash && !bslash:
-		return a.Path + "/" + b.Path, apath + "/" + bpath
+		return a.Path + "/" + b.Path, apath + bpath
 	}
 	return a.Path + b.Path, apath + bpath
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func header(pairs ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.Set(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestCacheEntryFreshnessLifetime(t *testing.T) {
+	ttl := 5 * time.Minute
+	tests := []struct {
+		name   string
+		entry  CacheEntry
+		want   time.Duration
+		wantOK bool
+	}{
+		{
+			name:   "ttl override wins over everything",
+			entry:  CacheEntry{Header: header("Cache-Control", "max-age=10"), TTLOverride: &ttl},
+			want:   ttl,
+			wantOK: true,
+		},
+		{
+			name:   "s-maxage wins over max-age",
+			entry:  CacheEntry{Header: header("Cache-Control", "max-age=10, s-maxage=20")},
+			want:   20 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "max-age wins over Expires",
+			entry:  CacheEntry{Header: header("Cache-Control", "max-age=30", "Expires", "Thu, 01 Jan 2026 00:10:00 GMT")},
+			want:   30 * time.Second,
+			wantOK: true,
+		},
+		{
+			name: "Expires used absent Cache-Control",
+			entry: CacheEntry{
+				StoredAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+				Header: header(
+					"Date", "Thu, 01 Jan 2026 00:00:00 GMT",
+					"Expires", "Thu, 01 Jan 2026 00:10:00 GMT",
+				),
+			},
+			want:   10 * time.Minute,
+			wantOK: true,
+		},
+		{
+			name:   "nothing present",
+			entry:  CacheEntry{Header: header()},
+			want:   0,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.entry.freshnessLifetime()
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("freshnessLifetime() = (%v, %v), want (%v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCacheEntryIsFresh(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry CacheEntry
+		want  bool
+	}{
+		{
+			name: "within max-age",
+			entry: CacheEntry{
+				StoredAt: time.Now(),
+				Header:   header("Cache-Control", "max-age=3600"),
+			},
+			want: true,
+		},
+		{
+			name: "past max-age",
+			entry: CacheEntry{
+				StoredAt: time.Now().Add(-2 * time.Hour),
+				Header:   header("Cache-Control", "max-age=3600"),
+			},
+			want: false,
+		},
+		{
+			name: "must-revalidate does not defeat freshness within max-age",
+			entry: CacheEntry{
+				StoredAt: time.Now(),
+				Header:   header("Cache-Control", "max-age=3600, must-revalidate"),
+			},
+			want: true,
+		},
+		{
+			name: "no-cache always forces revalidation",
+			entry: CacheEntry{
+				StoredAt: time.Now(),
+				Header:   header("Cache-Control", "max-age=3600, no-cache"),
+			},
+			want: false,
+		},
+		{
+			name: "no freshness info at all",
+			entry: CacheEntry{
+				StoredAt: time.Now(),
+				Header:   header(),
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.isFresh(); got != tt.want {
+				t.Fatalf("isFresh() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryStaleButUsable(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry CacheEntry
+		want  bool
+	}{
+		{
+			name: "within stale-while-revalidate window",
+			entry: CacheEntry{
+				StoredAt: time.Now().Add(-70 * time.Second),
+				Header:   header("Cache-Control", "max-age=60, stale-while-revalidate=30"),
+			},
+			want: true,
+		},
+		{
+			name: "past stale-while-revalidate window",
+			entry: CacheEntry{
+				StoredAt: time.Now().Add(-100 * time.Second),
+				Header:   header("Cache-Control", "max-age=60, stale-while-revalidate=30"),
+			},
+			want: false,
+		},
+		{
+			name: "must-revalidate forbids serving stale regardless of window",
+			entry: CacheEntry{
+				StoredAt: time.Now().Add(-70 * time.Second),
+				Header:   header("Cache-Control", "max-age=60, stale-while-revalidate=30, must-revalidate"),
+			},
+			want: false,
+		},
+		{
+			name: "no stale-while-revalidate directive",
+			entry: CacheEntry{
+				StoredAt: time.Now().Add(-70 * time.Second),
+				Header:   header("Cache-Control", "max-age=60"),
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.staleButUsable(); got != tt.want {
+				t.Fatalf("staleButUsable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachePolicyAllowed(t *testing.T) {
+	p := NewCachePolicy("*.deb,*.rpm", "Release,re:^/dists/.*/Packages$", "")
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/pool/main/f/foo_1.0.deb", true},
+		{"/pool/main/f/foo_1.0.rpm", true},
+		{"/pool/main/f/foo_1.0.tar.gz", false},
+		{"/dists/stable/Release", false},
+		{"/dists/stable/main/binary-amd64/Packages", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := p.Allowed(tt.path); got != tt.want {
+				t.Fatalf("Allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachePolicyTTL(t *testing.T) {
+	p := NewCachePolicy("", "", "*.deb=720h,Release=0s")
+
+	ttl, ok := p.TTL("/pool/main/f/foo_1.0.deb")
+	if !ok || ttl != 720*time.Hour {
+		t.Fatalf("TTL(*.deb) = (%v, %v), want (720h, true)", ttl, ok)
+	}
+
+	ttl, ok = p.TTL("/dists/stable/Release")
+	if !ok || ttl != 0 {
+		t.Fatalf("TTL(Release) = (%v, %v), want (0s, true)", ttl, ok)
+	}
+
+	if _, ok := p.TTL("/pool/main/f/foo_1.0.tar.gz"); ok {
+		t.Fatalf("TTL(unmatched) = ok, want no match")
+	}
+}
+
+func TestLocalCachePutStreamingMemLRURoundTrip(t *testing.T) {
+	const memBudget = 16
+
+	t.Run("body at budget is promoted to memory", func(t *testing.T) {
+		c := NewLocalCache(t.TempDir(), memBudget)
+		body := bytes.Repeat([]byte("a"), memBudget)
+		key := cacheKey("GET", "http://upstream/at-budget", nil, http.Header{})
+
+		if err := c.Put(key, CacheEntry{StatusCode: http.StatusOK}, bytes.NewReader(body)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		rc, _, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer rc.Close()
+
+		if c.stats.memHits != 1 {
+			t.Fatalf("memHits = %d, want 1 (body should have been promoted)", c.stats.memHits)
+		}
+	})
+
+	t.Run("body over budget is not promoted, and is served in full from disk", func(t *testing.T) {
+		c := NewLocalCache(t.TempDir(), memBudget)
+		body := bytes.Repeat([]byte("b"), memBudget*10)
+		key := cacheKey("GET", "http://upstream/over-budget", nil, http.Header{})
+
+		if err := c.Put(key, CacheEntry{StatusCode: http.StatusOK}, bytes.NewReader(body)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		rc, _, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer rc.Close()
+
+		got := &bytes.Buffer{}
+		if _, err := got.ReadFrom(rc); err != nil {
+			t.Fatalf("reading entry: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), body) {
+			t.Fatalf("served body len = %d, want %d (truncated copy was served)", got.Len(), len(body))
+		}
+		if c.stats.memHits != 0 {
+			t.Fatalf("memHits = %d, want 0 (oversized body must not be promoted)", c.stats.memHits)
+		}
+	})
+}